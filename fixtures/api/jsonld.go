@@ -0,0 +1,44 @@
+// Package api provides fake upstream HTTP APIs used by the gateway test suite.
+package api
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// JSONLDHandler is a fake upstream API serving a tiny JSON-LD document graph.
+// It is only used by tests.
+type JSONLDHandler struct{}
+
+func (h *JSONLDHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/forwarded":
+		fmt.Fprintf(w, "X-Forwarded-Host: %s\nX-Forwarded-Proto: %s", r.Header.Get("X-Forwarded-Host"), r.Header.Get("X-Forwarded-Proto"))
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			fmt.Fprintf(w, "\nX-Forwarded-For: %s", xff)
+		}
+
+	case "/books.jsonld":
+		w.Header().Set("Content-Type", "application/ld+json")
+		fmt.Fprint(w, `{"hydra:member":["/books/1.jsonld","/books/2.jsonld"]}`)
+
+	case "/books/1.jsonld":
+		w.Header().Set("Content-Type", "application/ld+json")
+		fmt.Fprint(w, `{"author":"/authors/1.jsonld","related":"/books/99.jsonld"}`)
+
+	case "/books/2.jsonld":
+		w.Header().Set("Content-Type", "application/ld+json")
+		fmt.Fprint(w, `{"author":"/authors/2.jsonld"}`)
+
+	case "/authors/1.jsonld", "/authors/2.jsonld":
+		w.Header().Set("Content-Type", "application/ld+json")
+		fmt.Fprint(w, `{"name":"Kévin"}`)
+
+	case "/books/99.jsonld":
+		w.Header().Set("Content-Type", "application/ld+json")
+		fmt.Fprint(w, `{"name":"Voyage au centre de la Terre"}`)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
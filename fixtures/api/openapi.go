@@ -0,0 +1,26 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// OpenAPIHandler is a fake upstream API serving plain JSON (not JSON-LD)
+// resources, used by the tests that configure the gateway with an OpenAPI
+// file. It is only used by tests.
+type OpenAPIHandler struct{}
+
+func (h *OpenAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/books/1":
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"author":"/authors/1"}`)
+
+	case "/authors/1":
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"name":"Kévin"}`)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
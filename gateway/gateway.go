@@ -0,0 +1,119 @@
+// Package gateway implements the Vulcain HTTP/2 gateway: it sits in front of
+// an upstream API, adds preload/fields support on top of its responses, and
+// turns the relations it discovers into HTTP/2 server pushes or preload Link
+// headers.
+package gateway
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+
+	"golang.org/x/net/http2"
+)
+
+// Gateway is the Vulcain reverse proxy.
+type Gateway struct {
+	options *Options
+	server  *http.Server
+	proxy   *httputil.ReverseProxy
+}
+
+// NewGateway creates a Vulcain gateway reverse-proxying to options.Upstream.
+func NewGateway(options *Options) *Gateway {
+	g := &Gateway{options: options}
+
+	g.proxy = httputil.NewSingleHostReverseProxy(options.Upstream)
+	transport, err := newTransport(options)
+	if err != nil {
+		log.Fatal(err)
+	}
+	g.proxy.Transport = transport
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", g.handle)
+
+	g.server = &http.Server{
+		Addr:    options.Addr,
+		Handler: mux,
+	}
+
+	return g
+}
+
+// Serve starts the HTTPS/HTTP2 server. It blocks until the server is shut down.
+func (g *Gateway) Serve() error {
+	if err := http2.ConfigureServer(g.server, &http2.Server{}); err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(g.options.CertFile, g.options.KeyFile)
+	if err != nil {
+		return err
+	}
+	if g.server.TLSConfig == nil {
+		g.server.TLSConfig = &tls.Config{}
+	}
+	g.server.TLSConfig.Certificates = []tls.Certificate{cert}
+
+	ln, err := net.Listen("tcp", g.options.Addr)
+	if err != nil {
+		return err
+	}
+
+	if g.options.UseProxyProtocol {
+		ln, err = newProxyProtoListener(ln, g.options.TrustedProxies)
+		if err != nil {
+			return err
+		}
+	}
+
+	return g.server.ServeTLS(ln, "", "")
+}
+
+func (g *Gateway) handle(w http.ResponseWriter, r *http.Request) {
+	g.setForwardedHeaders(r)
+
+	rec := newPushRecorder(w, r, g)
+	stripRelationParams(r)
+	g.proxy.ServeHTTP(rec, r)
+	rec.flush()
+}
+
+// stripRelationParams removes the Preload/Fields headers and query params
+// from r so that the upstream API, which knows nothing about them, never
+// sees them.
+func stripRelationParams(r *http.Request) {
+	r.Header.Del("Preload")
+	r.Header.Del("Fields")
+
+	q := r.URL.Query()
+	if _, ok := q["preload"]; !ok {
+		if _, ok := q["fields"]; !ok {
+			return
+		}
+	}
+
+	q.Del("preload")
+	q.Del("fields")
+	r.URL.RawQuery = q.Encode()
+}
+
+func (g *Gateway) setForwardedHeaders(r *http.Request) {
+	host := r.Host
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	r.Header.Set("X-Forwarded-Host", host)
+	r.Header.Set("X-Forwarded-Proto", proto)
+
+	if host, _, err := splitHostPort(r.RemoteAddr); err == nil {
+		r.Header.Add("X-Forwarded-For", host)
+	} else {
+		log.Printf("vulcain: invalid remote address %q: %v", r.RemoteAddr, err)
+	}
+}
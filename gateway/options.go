@@ -0,0 +1,40 @@
+package gateway
+
+import "net/url"
+
+// Options contains the Vulcain gateway configuration.
+type Options struct {
+	Addr        string
+	CertFile    string
+	KeyFile     string
+	Upstream    *url.URL
+	MaxPushes   int
+	OpenAPIFile string
+	Proxy       *ProxyOptions
+
+	// UseProxyProtocol makes the gateway recover the client address from a
+	// PROXY protocol v1/v2 header sent by a TCP load balancer in front of it.
+	UseProxyProtocol bool
+	// TrustedProxies lists the CIDRs allowed to send a PROXY protocol header.
+	TrustedProxies []string
+
+	// UpstreamCABundle is a PEM-encoded bundle of CA certificates trusted in
+	// addition to the system pool when connecting to Upstream over TLS.
+	UpstreamCABundle []byte
+	// UpstreamClientCertFile and UpstreamClientKeyFile configure a client
+	// certificate presented to Upstream for mTLS.
+	UpstreamClientCertFile string
+	UpstreamClientKeyFile  string
+	// UpstreamInsecureSkipTLS disables upstream certificate verification.
+	// Only meant for development.
+	UpstreamInsecureSkipTLS bool
+}
+
+// ProxyOptions configures the upstream HTTP/HTTPS proxy the gateway's
+// transport dials through to reach Upstream.
+type ProxyOptions struct {
+	URL      string
+	Username string
+	Password string
+	NoProxy  string
+}
@@ -0,0 +1,111 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/http2"
+)
+
+// newTransport builds the http.RoundTripper used by the reverse proxy to
+// reach Upstream, routing it through options.Proxy and options.Upstream* TLS
+// settings when configured.
+func newTransport(options *Options) (http.RoundTripper, error) {
+	tlsConfig, err := upstreamTLSConfig(options)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{TLSClientConfig: tlsConfig}
+
+	proxyFunc, err := proxyFuncFor(options.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	transport.Proxy = proxyFunc
+
+	if err := http2.ConfigureTransport(transport); err != nil {
+		return nil, err
+	}
+
+	return transport, nil
+}
+
+// upstreamTLSConfig builds the *tls.Config used to connect to Upstream over
+// TLS from the Upstream* options.
+func upstreamTLSConfig(options *Options) (*tls.Config, error) {
+	if len(options.UpstreamCABundle) == 0 && options.UpstreamClientCertFile == "" && !options.UpstreamInsecureSkipTLS {
+		return nil, nil
+	}
+
+	config := &tls.Config{InsecureSkipVerify: options.UpstreamInsecureSkipTLS}
+
+	if len(options.UpstreamCABundle) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(options.UpstreamCABundle) {
+			return nil, fmt.Errorf("vulcain: no valid certificate found in the upstream CA bundle")
+		}
+
+		config.RootCAs = pool
+	}
+
+	if options.UpstreamClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.UpstreamClientCertFile, options.UpstreamClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("vulcain: invalid upstream client certificate: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// proxyFuncFor returns the http.Transport.Proxy function matching the given
+// ProxyOptions, falling back to http.ProxyFromEnvironment when po is nil or
+// its URL is empty.
+func proxyFuncFor(po *ProxyOptions) (func(*http.Request) (*url.URL, error), error) {
+	if po == nil || po.URL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	proxyURL, err := url.Parse(po.URL)
+	if err != nil {
+		return nil, fmt.Errorf("vulcain: invalid upstream proxy URL: %w", err)
+	}
+
+	if po.Username != "" {
+		proxyURL.User = url.UserPassword(po.Username, po.Password)
+	}
+
+	// Without a NoProxy list every request goes through the proxy, loopback
+	// upstreams included.
+	if po.NoProxy == "" {
+		return http.ProxyURL(proxyURL), nil
+	}
+
+	// With a NoProxy list, httpproxy's matching rules apply; they also never
+	// proxy requests to localhost or loopback addresses.
+	//
+	// httpproxy.Config picks HTTPProxy/HTTPSProxy based on the scheme of the
+	// request being proxied, not on the proxy's own scheme: a single
+	// configured proxy must be used for both HTTP and HTTPS upstreams.
+	config := &httpproxy.Config{
+		NoProxy:    po.NoProxy,
+		HTTPProxy:  proxyURL.String(),
+		HTTPSProxy: proxyURL.String(),
+	}
+
+	fn := config.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return fn(req.URL)
+	}, nil
+}
@@ -0,0 +1,195 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var proxyProtoV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// proxyProtoHeaderTimeout bounds how long Accept waits for a trusted peer to
+// send its PROXY protocol header. The header is read inside Accept, so no
+// other connection is accepted while it waits.
+const proxyProtoHeaderTimeout = 5 * time.Second
+
+// proxyProtoListener accepts connections prefixed with a PROXY protocol v1 or
+// v2 header (https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt) and
+// recovers the real client address from it, but only when the immediate peer
+// is one of trustedProxies.
+type proxyProtoListener struct {
+	net.Listener
+	trustedProxies []*net.IPNet
+}
+
+// newProxyProtoListener wraps ln so that Accept returns connections whose
+// RemoteAddr reflects the address carried by a PROXY protocol header, when
+// the dialing peer is trusted.
+func newProxyProtoListener(ln net.Listener, trustedProxies []string) (*proxyProtoListener, error) {
+	nets := make([]*net.IPNet, 0, len(trustedProxies))
+	for _, cidr := range trustedProxies {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("vulcain: invalid trusted proxy CIDR %q: %w", cidr, err)
+		}
+		nets = append(nets, n)
+	}
+
+	return &proxyProtoListener{Listener: ln, trustedProxies: nets}, nil
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(proxyProtoHeaderTimeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	remoteAddr, err := readProxyProtoHeader(r)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("vulcain: invalid PROXY protocol header: %w", err)
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	wrapped := &proxyProtoConn{Conn: conn, r: r}
+	if remoteAddr != nil {
+		wrapped.remoteAddr = remoteAddr
+	}
+
+	return wrapped, nil
+}
+
+func (l *proxyProtoListener) isTrusted(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range l.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readProxyProtoHeader consumes a PROXY protocol header from r and returns
+// the address it carries, or nil for an UNKNOWN (e.g. health check) header.
+func readProxyProtoHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyProtoV2Signature))
+	if err == nil && string(sig) == string(proxyProtoV2Signature) {
+		return readProxyProtoV2(r)
+	}
+
+	return readProxyProtoV1(r)
+}
+
+func readProxyProtoV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(strings.TrimSpace(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("not a PROXY protocol v1 header: %q", line)
+	}
+
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header: %q", line)
+	}
+
+	port, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, err
+	}
+
+	return &net.TCPAddr{IP: net.ParseIP(fields[2]), Port: port}, nil
+}
+
+func readProxyProtoV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	verCmd := header[12]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version: %d", verCmd>>4)
+	}
+
+	length := binary.BigEndian.Uint16(header[14:16])
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	// LOCAL command (health checks): no address to recover.
+	if verCmd&0x0F == 0 {
+		return nil, nil
+	}
+
+	family := header[13] >> 4
+	switch family {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, fmt.Errorf("malformed PROXY protocol v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("malformed PROXY protocol v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// proxyProtoConn overrides RemoteAddr with the address recovered from the
+// PROXY protocol header, while reading through the buffered reader that
+// consumed it.
+type proxyProtoConn struct {
+	net.Conn
+	r          *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+
+	return c.Conn.RemoteAddr()
+}
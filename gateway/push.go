@@ -0,0 +1,317 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// pushRecorder wraps the response writer returned by the reverse proxy so
+// that preload/fields query params and headers can be turned into preload
+// Link headers (and, on HTTP/2 connections, actual server pushes) once the
+// upstream response body has been read.
+type pushRecorder struct {
+	http.ResponseWriter
+	req        *http.Request
+	g          *Gateway
+	buf        bytes.Buffer
+	statusCode int
+	preload    []string
+	fields     []string
+}
+
+// newPushRecorder captures the preload/fields relations requested by r
+// before the caller strips them off of the request forwarded upstream.
+func newPushRecorder(w http.ResponseWriter, r *http.Request, g *Gateway) *pushRecorder {
+	return &pushRecorder{
+		ResponseWriter: w,
+		req:            r,
+		g:              g,
+		preload:        relationsOf(r, "Preload", "preload"),
+		fields:         relationsOf(r, "Fields", "fields"),
+	}
+}
+
+// WriteHeader defers committing the status line so that flush can still
+// rewrite the headers (add Link, drop the now-stale Content-Length) before
+// anything reaches the wire.
+func (p *pushRecorder) WriteHeader(statusCode int) {
+	p.statusCode = statusCode
+}
+
+func (p *pushRecorder) Write(b []byte) (int, error) {
+	return p.buf.Write(b)
+}
+
+// relation is a single resource discovered while resolving a preload
+// pointer. childPointer is empty for a relation pointing directly at a
+// field's value (pushed as-is); it carries the remaining path once the
+// pointer went through a "*" wildcard, so that it can be attached to the
+// pushed URL and applied once that resource is in turn requested.
+type relation struct {
+	url          string
+	childPointer string
+}
+
+// flush rewrites the body to carry the requested preload relations over to
+// the next hop, pushes them when possible, and writes the final response.
+func (p *pushRecorder) flush() {
+	if len(p.preload) == 0 && len(p.fields) == 0 {
+		p.commit(p.buf.Bytes())
+		return
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(p.buf.Bytes(), &doc); err != nil {
+		p.commit(p.buf.Bytes())
+		return
+	}
+
+	pushed := 0
+	for _, pointer := range p.preload {
+		for _, rel := range resolveRelations(doc, pointer) {
+			target := rel.url
+			if rel.childPointer != "" {
+				target = addQueryParam(rel.url, "preload", rel.childPointer)
+				p.replaceValue(doc, rel.url, target)
+			}
+
+			link := fmt.Sprintf("<%s>; rel=preload; as=fetch", target)
+			p.Header().Add("Link", link)
+
+			if p.g.options.MaxPushes < 0 || pushed < p.g.options.MaxPushes {
+				if pusher, ok := p.ResponseWriter.(http.Pusher); ok {
+					if err := pusher.Push(target, nil); err == nil {
+						pushed++
+					}
+				}
+			}
+		}
+	}
+
+	b, err := json.Marshal(selectFields(doc, p.fields))
+	if err != nil {
+		p.commit(p.buf.Bytes())
+		return
+	}
+
+	p.commit(b)
+}
+
+// commit writes the final status line, headers and body. It must be the
+// only path that reaches the underlying ResponseWriter: WriteHeader only
+// records the upstream's status code, so that flush can add Link headers
+// and drop the upstream's Content-Length (now stale, since body may have
+// been rewritten to a different length) before anything is committed to
+// the wire.
+func (p *pushRecorder) commit(body []byte) {
+	p.Header().Del("Content-Length")
+
+	if p.statusCode == 0 {
+		p.statusCode = http.StatusOK
+	}
+	p.ResponseWriter.WriteHeader(p.statusCode)
+
+	p.ResponseWriter.Write(body)
+}
+
+// replaceValue rewrites, in place, the string value from to to wherever it
+// appears in doc.
+func (p *pushRecorder) replaceValue(doc interface{}, from, to string) {
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	for k, v := range m {
+		if s, ok := v.(string); ok && s == from {
+			m[k] = to
+			continue
+		}
+
+		if arr, ok := v.([]interface{}); ok {
+			for i, e := range arr {
+				if s, ok := e.(string); ok && s == from {
+					arr[i] = to
+				}
+			}
+		}
+	}
+}
+
+// relationsOf reads a comma-separated relation list from the named header,
+// falling back to the query param with the same name.
+func relationsOf(r *http.Request, header, query string) []string {
+	var raw []string
+	if values := r.Header.Values(header); len(values) > 0 {
+		for _, v := range values {
+			raw = append(raw, strings.Split(v, ",")...)
+		}
+	} else if v := r.URL.Query().Get(query); v != "" {
+		raw = strings.Split(v, ",")
+	}
+
+	for i, v := range raw {
+		raw[i] = strings.TrimSpace(v)
+	}
+
+	return raw
+}
+
+// resolveRelations walks doc along pointer, a slash-separated JSON pointer
+// that may contain one "*" segment to iterate over an array or over every
+// value of an object.
+//
+// A pointer with no wildcard is resolved all the way to its leaf string
+// value(s): these are pushed as-is, since the pointer already names the
+// final relation.
+//
+// A pointer that goes through a wildcard stops resolving at the wildcarded
+// level: each matched string (e.g. a member's URL) is returned together with
+// whatever pointer segments remained after the wildcard, so the caller can
+// carry that remainder over to the pushed resource as its own preload.
+func resolveRelations(doc interface{}, pointer string) []relation {
+	segments := strings.Split(strings.Trim(pointer, "/"), "/")
+	values := []interface{}{doc}
+
+	for i, seg := range segments {
+		if seg == "*" {
+			var items []interface{}
+			for _, v := range values {
+				switch t := v.(type) {
+				case []interface{}:
+					items = append(items, t...)
+				case map[string]interface{}:
+					for _, child := range t {
+						items = append(items, child)
+					}
+				}
+			}
+
+			var remaining string
+			if rest := segments[i+1:]; len(rest) > 0 {
+				remaining = "/" + strings.Join(rest, "/")
+			}
+
+			var relations []relation
+			for _, item := range items {
+				if s, ok := item.(string); ok {
+					relations = append(relations, relation{url: s, childPointer: remaining})
+				}
+			}
+
+			return relations
+		}
+
+		var next []interface{}
+		for _, v := range values {
+			if m, ok := v.(map[string]interface{}); ok {
+				if child, ok := m[seg]; ok {
+					next = append(next, child)
+				}
+			}
+		}
+		values = next
+	}
+
+	var relations []relation
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			relations = append(relations, relation{url: s})
+		}
+	}
+
+	return relations
+}
+
+// selectFields projects doc down to the top-level fields named by the
+// Fields relation list, when one was given. Otherwise doc is returned
+// unchanged. Fields are inserted in the reverse of the list's order: the
+// last-listed field comes first in the rewritten body, whatever order the
+// upstream document had them in.
+func selectFields(doc interface{}, fields []string) interface{} {
+	if len(fields) == 0 {
+		return doc
+	}
+
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return doc
+	}
+
+	selected := newOrderedObject()
+	for i := len(fields) - 1; i >= 0; i-- {
+		key := strings.SplitN(strings.Trim(fields[i], "/"), "/", 2)[0]
+		if v, ok := m[key]; ok {
+			selected.set(key, v)
+		}
+	}
+
+	return selected
+}
+
+// orderedObject is a JSON object that marshals its keys in insertion order,
+// instead of the alphabetical order encoding/json imposes on map[string]interface{}.
+type orderedObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newOrderedObject() *orderedObject {
+	return &orderedObject{values: map[string]interface{}{}}
+}
+
+func (o *orderedObject) set(key string, value interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *orderedObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+
+		v, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func addQueryParam(rawURL, key, value string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	q := u.Query()
+	q.Set(key, value)
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
+
+func splitHostPort(addr string) (string, string, error) {
+	return net.SplitHostPort(addr)
+}
@@ -1,18 +1,23 @@
 package gateway
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
-	"os"
-	"os/exec"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/dunglas/vulcain/fixtures/api"
+	"github.com/dunglas/vulcain/gateway/testutil"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/http2"
 )
@@ -64,7 +69,7 @@ func TestForwardedHeaders(t *testing.T) {
 
 	b, _ := ioutil.ReadAll(resp.Body)
 
-	assert.Equal(t, "X-Forwarded-Host: 127.0.0.1:4343\nX-Forwarded-Proto: https", string(b))
+	assert.Contains(t, string(b), "X-Forwarded-Host: 127.0.0.1:4343\nX-Forwarded-Proto: https")
 	_ = g.server.Shutdown(context.Background())
 }
 
@@ -105,52 +110,525 @@ func TestMultipleValues(t *testing.T) {
 	_ = g.server.Shutdown(context.Background())
 }
 
-// Unfortunately, Go's HTTP client doesn't support Pushes yet (https://github.com/golang/go/issues/18594)
-// In the meantime, we use Symfony HttpClient
+var insecureSkipVerify = &tls.Config{InsecureSkipVerify: true}
+
+// TestH2Push locks down which relations get pushed for every combination of
+// the preload/fields relation list carried as a query param or as a header.
 func TestH2Push(t *testing.T) {
 	upstream, g, _ := createTestingUtils("")
 	defer upstream.Close()
+	defer g.server.Shutdown(context.Background())
 
-	for _, test := range []string{"fields-query", "fields-header", "preload-query", "preload-header", "fields-preload-query", "fields-preload-header"} {
-		cmd := exec.Command("../test-push/" + test + ".php")
-		cmd.Env = os.Environ()
-		cmd.Env = append(cmd.Env, "GATEWAY_URL="+gatewayURL)
-		stdoutStderr, err := cmd.CombinedOutput()
-		if !assert.NoError(t, err) {
-			t.Log(string(stdoutStderr))
-		}
+	cases := []struct {
+		name    string
+		query   string
+		headers http.Header
+		want    []string
+	}{
+		{name: "fields-query", query: "fields=/author", want: nil},
+		{name: "fields-header", headers: http.Header{"Fields": {"/author"}}, want: nil},
+		{name: "preload-query", query: "preload=/author", want: []string{"/authors/1.jsonld"}},
+		{name: "preload-header", headers: http.Header{"Preload": {"/author"}}, want: []string{"/authors/1.jsonld"}},
+		{name: "fields-preload-query", query: "fields=/author&preload=/author", want: []string{"/authors/1.jsonld"}},
+		{name: "fields-preload-header", headers: http.Header{"Fields": {"/author"}, "Preload": {"/author"}}, want: []string{"/authors/1.jsonld"}},
 	}
 
-	_ = g.server.Shutdown(context.Background())
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			target := gatewayURL + "/books/1.jsonld"
+			if c.query != "" {
+				target += "?" + c.query
+			}
+
+			var mainResp *http.Response
+			var pushed []testutil.PushedResource
+			var err error
+			for mainResp == nil {
+				mainResp, pushed, err = testutil.CollectPushes(insecureSkipVerify, target, c.headers)
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			var gotPaths []string
+			for _, p := range pushed {
+				gotPaths = append(gotPaths, strings.SplitN(p.Path, "?", 2)[0])
+			}
+
+			assert.Equal(t, c.want, gotPaths)
+		})
+	}
 }
 
 func TestH2PushLimit(t *testing.T) {
 	upstream, g, _ := createTestingUtils("")
-	g.options.MaxPushes = 2
+	g.options.MaxPushes = 1
 	defer upstream.Close()
+	defer g.server.Shutdown(context.Background())
 
-	cmd := exec.Command("../test-push/push-limit.php")
-	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, "GATEWAY_URL="+gatewayURL)
-	stdoutStderr, err := cmd.CombinedOutput()
+	var mainResp *http.Response
+	var pushed []testutil.PushedResource
+	var err error
+	for mainResp == nil {
+		mainResp, pushed, err = testutil.CollectPushes(insecureSkipVerify, gatewayURL+"/books/1.jsonld?preload=/author,/related", nil)
+	}
 	if !assert.NoError(t, err) {
-		t.Log(string(stdoutStderr))
+		return
 	}
 
-	_ = g.server.Shutdown(context.Background())
+	assert.Len(t, pushed, 1, "no more than MaxPushes resources should be pushed")
+}
+
+// connectProxy is a minimal in-process HTTP CONNECT proxy used to assert
+// that the gateway routes its upstream traffic through a configured proxy.
+type connectProxy struct {
+	ln       net.Listener
+	user     string
+	password string
+
+	mu   sync.Mutex
+	hits int
+}
+
+func newConnectProxy(t *testing.T, user, password string) *connectProxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	p := &connectProxy{ln: ln, user: user, password: password}
+	go p.serve(t)
+
+	return p
+}
+
+func (p *connectProxy) serve(t *testing.T) {
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go p.handle(t, conn)
+	}
+}
+
+func (p *connectProxy) handle(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return
+	}
+
+	if !p.authorized(req) {
+		conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+		return
+	}
+
+	if req.Method == http.MethodConnect {
+		p.handleConnect(conn, r, req)
+		return
+	}
+
+	// An http:// upstream is proxied in absolute-form instead of through a
+	// CONNECT tunnel: https://tools.ietf.org/html/rfc7230#section-5.3.2.
+	p.handleForward(conn, req)
+}
+
+func (p *connectProxy) authorized(req *http.Request) bool {
+	if p.user == "" {
+		return true
+	}
+
+	u, pwd, ok := parseProxyBasicAuth(req)
+	return ok && u == p.user && pwd == p.password
+}
+
+func (p *connectProxy) handleConnect(conn net.Conn, r *bufio.Reader, req *http.Request) {
+	upstream, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		return
+	}
+	defer upstream.Close()
+
+	p.mu.Lock()
+	p.hits++
+	p.mu.Unlock()
+	conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(upstream, r); done <- struct{}{} }()
+	go func() { io.Copy(conn, upstream); done <- struct{}{} }()
+	<-done
+}
+
+func (p *connectProxy) handleForward(conn net.Conn, req *http.Request) {
+	upstream, err := net.Dial("tcp", req.URL.Host)
+	if err != nil {
+		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		return
+	}
+	defer upstream.Close()
+
+	if err := req.Write(upstream); err != nil {
+		return
+	}
+
+	p.mu.Lock()
+	p.hits++
+	p.mu.Unlock()
+
+	io.Copy(conn, upstream)
+}
+
+func (p *connectProxy) Close() { p.ln.Close() }
+
+// parseProxyBasicAuth reads the credentials a proxying http.Transport sends
+// in the Proxy-Authorization header; unlike Request.BasicAuth, which only
+// looks at Authorization.
+func parseProxyBasicAuth(req *http.Request) (user, password string, ok bool) {
+	const prefix = "Basic "
+
+	auth := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+
+	user, password, ok = strings.Cut(string(decoded), ":")
+	return user, password, ok
+}
+
+func (p *connectProxy) Hits() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.hits
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	proxy := newConnectProxy(t, "alice", "s3cr3t")
+	defer proxy.Close()
+
+	upstream := httptest.NewServer(&api.JSONLDHandler{})
+	defer upstream.Close()
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+	g := NewGateway(&Options{
+		Addr:      testAddr,
+		MaxPushes: -1,
+		Upstream:  upstreamURL,
+		CertFile:  "../fixtures/tls/server.crt",
+		KeyFile:   "../fixtures/tls/server.key",
+		Proxy: &ProxyOptions{
+			URL:      "http://" + proxy.ln.Addr().String(),
+			Username: "alice",
+			Password: "s3cr3t",
+		},
+	})
+	go func() { g.Serve() }()
+	defer g.server.Shutdown(context.Background())
+
+	transport := &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	client := http.Client{Transport: transport, Timeout: time.Duration(100 * time.Millisecond)}
+
+	var resp *http.Response
+	for resp == nil {
+		resp, _ = client.Get(gatewayURL + "/forwarded")
+	}
+	resp.Body.Close()
+
+	assert.Greater(t, proxy.Hits(), 0, "the gateway should have routed its upstream request through the proxy")
+}
+
+func TestUpstreamProxyTLSUpstream(t *testing.T) {
+	proxy := newConnectProxy(t, "", "")
+	defer proxy.Close()
+
+	upstream := httptest.NewTLSServer(&api.JSONLDHandler{})
+	defer upstream.Close()
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+	g := NewGateway(&Options{
+		Addr:                    testAddr,
+		MaxPushes:               -1,
+		Upstream:                upstreamURL,
+		CertFile:                "../fixtures/tls/server.crt",
+		KeyFile:                 "../fixtures/tls/server.key",
+		Proxy:                   &ProxyOptions{URL: "http://" + proxy.ln.Addr().String()},
+		UpstreamInsecureSkipTLS: true,
+	})
+	go func() { g.Serve() }()
+	defer g.server.Shutdown(context.Background())
+
+	transport := &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	client := http.Client{Transport: transport, Timeout: time.Duration(100 * time.Millisecond)}
+
+	var resp *http.Response
+	for resp == nil {
+		resp, _ = client.Get(gatewayURL + "/forwarded")
+	}
+	resp.Body.Close()
+
+	assert.Greater(t, proxy.Hits(), 0, "the gateway should have routed its HTTPS upstream request through the proxy")
+}
+
+// proxyv2DialContext returns a DialContext that, once the TCP connection is
+// established, prepends a fabricated PROXY protocol v2 header claiming the
+// client is srcAddr before handing the connection back to the caller.
+func proxyv2DialContext(srcAddr, dstAddr string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := conn.Write(encodeProxyProtoV2(srcAddr, dstAddr)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return conn, nil
+	}
+}
+
+func encodeProxyProtoV2(srcAddr, dstAddr string) []byte {
+	src, _ := net.ResolveTCPAddr("tcp", srcAddr)
+	dst, _ := net.ResolveTCPAddr("tcp", dstAddr)
+
+	header := []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+	header = append(header, 0x21)       // version 2, command PROXY
+	header = append(header, 0x11)       // AF_INET, STREAM
+	header = append(header, 0x00, 0x0C) // address block length: 12 bytes
+
+	header = append(header, src.IP.To4()...)
+	header = append(header, dst.IP.To4()...)
+	header = append(header, byte(src.Port>>8), byte(src.Port))
+	header = append(header, byte(dst.Port>>8), byte(dst.Port))
+
+	return header
+}
+
+func TestProxyProtocol(t *testing.T) {
+	upstream := httptest.NewServer(&api.JSONLDHandler{})
+	defer upstream.Close()
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+	g := NewGateway(&Options{
+		Addr:             testAddr,
+		MaxPushes:        -1,
+		Upstream:         upstreamURL,
+		CertFile:         "../fixtures/tls/server.crt",
+		KeyFile:          "../fixtures/tls/server.key",
+		UseProxyProtocol: true,
+		TrustedProxies:   []string{"127.0.0.1/32"},
+	})
+	go func() { g.Serve() }()
+	defer g.server.Shutdown(context.Background())
+
+	// dial through a fabricated PROXY protocol v2 header pretending the
+	// client is 10.1.1.1:1000, and assert the gateway recovers it instead
+	// of reporting its own loopback peer address.
+	transport := &http2.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			conn, err := proxyv2DialContext("10.1.1.1:1000", "20.2.2.2:2000")(context.Background(), network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			return tls.Client(conn, cfg), nil
+		},
+	}
+	client := http.Client{Transport: transport, Timeout: time.Duration(100 * time.Millisecond)}
+
+	var resp *http.Response
+	for resp == nil {
+		resp, _ = client.Get(gatewayURL + "/forwarded")
+	}
+
+	b, _ := ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(b), "X-Forwarded-For: 10.1.1.1")
+}
+
+func TestUpstreamTLSCABundle(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(&api.JSONLDHandler{})
+	cert, err := tls.LoadX509KeyPair("../fixtures/tls/server.crt", "../fixtures/tls/server.key")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	upstream.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	caBundle, err := ioutil.ReadFile("../fixtures/tls/server.crt")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+	g := NewGateway(&Options{
+		Addr:             testAddr,
+		MaxPushes:        -1,
+		Upstream:         upstreamURL,
+		CertFile:         "../fixtures/tls/server.crt",
+		KeyFile:          "../fixtures/tls/server.key",
+		UpstreamCABundle: caBundle,
+	})
+	go func() { g.Serve() }()
+	defer g.server.Shutdown(context.Background())
+
+	transport := &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	client := http.Client{Transport: transport, Timeout: time.Duration(100 * time.Millisecond)}
+
+	var resp *http.Response
+	for resp == nil {
+		resp, _ = client.Get(gatewayURL + "/forwarded")
+	}
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestUpstreamTLSWithoutCABundleFails(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(&api.JSONLDHandler{})
+	cert, err := tls.LoadX509KeyPair("../fixtures/tls/server.crt", "../fixtures/tls/server.key")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	upstream.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+	g := NewGateway(&Options{
+		Addr:      testAddr,
+		MaxPushes: -1,
+		Upstream:  upstreamURL,
+		CertFile:  "../fixtures/tls/server.crt",
+		KeyFile:   "../fixtures/tls/server.key",
+	})
+	go func() { g.Serve() }()
+	defer g.server.Shutdown(context.Background())
+
+	transport := &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	client := http.Client{Transport: transport, Timeout: time.Duration(100 * time.Millisecond)}
+
+	var resp *http.Response
+	for resp == nil {
+		resp, _ = client.Get(gatewayURL + "/forwarded")
+	}
+
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
+
+// TestUpstreamContract locks down exactly what the gateway sends to the
+// upstream API: the Preload/Fields headers are consumed rather than
+// forwarded, hop-by-hop headers are stripped, and the resolved preload
+// relation comes back as a Link header.
+func TestUpstreamContract(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+	defer upstream.Close()
+
+	upstream.AppendHandlers(
+		testutil.VerifyRequest("GET", "/books/1.jsonld"),
+		testutil.VerifyMissingHeader("Preload", "Fields", "Connection"),
+		testutil.RespondWithJSON(http.StatusOK, map[string]string{"author": "/authors/1.jsonld"}),
+	)
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+	g := NewGateway(&Options{
+		Addr:      testAddr,
+		MaxPushes: -1,
+		Upstream:  upstreamURL,
+		CertFile:  "../fixtures/tls/server.crt",
+		KeyFile:   "../fixtures/tls/server.key",
+	})
+	go func() { g.Serve() }()
+	defer g.server.Shutdown(context.Background())
+
+	transport := &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	client := http.Client{Transport: transport, Timeout: time.Duration(100 * time.Millisecond)}
+
+	var resp *http.Response
+	for resp == nil {
+		req, _ := http.NewRequest("GET", gatewayURL+"/books/1.jsonld?preload=/author", nil)
+		req.Header.Set("Connection", "keep-alive")
+		resp, _ = client.Do(req)
+	}
+
+	b, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, `{"author":"/authors/1.jsonld"}`, string(b))
+	assert.Equal(t, []string{"</authors/1.jsonld>; rel=preload; as=fetch"}, resp.Header["Link"])
+}
+
+// TestUpstreamForwardedHeadersAlwaysSet locks down that X-Forwarded-Host,
+// X-Forwarded-Proto and X-Forwarded-For are populated on every request sent
+// upstream, not just ones carrying preload/fields.
+func TestUpstreamForwardedHeadersAlwaysSet(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+	defer upstream.Close()
+
+	upstream.AppendHandlers(
+		testutil.VerifyRequest("GET", "/books/1.jsonld"),
+		testutil.VerifyHeader(http.Header{
+			"X-Forwarded-Host":  {testAddr},
+			"X-Forwarded-Proto": {"https"},
+		}),
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Forwarded-For") == "" {
+				t.Errorf("expected X-Forwarded-For to be set")
+			}
+		},
+		testutil.RespondWithJSON(http.StatusOK, map[string]string{}),
+	)
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+	g := NewGateway(&Options{
+		Addr:      testAddr,
+		MaxPushes: -1,
+		Upstream:  upstreamURL,
+		CertFile:  "../fixtures/tls/server.crt",
+		KeyFile:   "../fixtures/tls/server.key",
+	})
+	go func() { g.Serve() }()
+	defer g.server.Shutdown(context.Background())
+
+	transport := &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	client := http.Client{Transport: transport, Timeout: time.Duration(100 * time.Millisecond)}
+
+	var resp *http.Response
+	for resp == nil {
+		resp, _ = client.Get(gatewayURL + "/books/1.jsonld")
+	}
+	resp.Body.Close()
 }
 
 func TestH2PushOpenAPI(t *testing.T) {
 	upstream, g, _ := createTestingUtils("../fixtures/openapi.yaml")
 	defer upstream.Close()
+	defer g.server.Shutdown(context.Background())
 
-	cmd := exec.Command("../test-push/push-openapi.php")
-	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, "GATEWAY_URL="+gatewayURL)
-	stdoutStderr, err := cmd.CombinedOutput()
+	var mainResp *http.Response
+	var pushed []testutil.PushedResource
+	var err error
+	for mainResp == nil {
+		mainResp, pushed, err = testutil.CollectPushes(insecureSkipVerify, gatewayURL+"/books/1?preload=/author", nil)
+	}
 	if !assert.NoError(t, err) {
-		t.Log(string(stdoutStderr))
+		return
 	}
 
-	_ = g.server.Shutdown(context.Background())
+	var gotPaths []string
+	for _, p := range pushed {
+		gotPaths = append(gotPaths, strings.SplitN(p.Path, "?", 2)[0])
+	}
+
+	assert.Equal(t, []string{"/authors/1"}, gotPaths)
 }
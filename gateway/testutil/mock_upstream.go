@@ -0,0 +1,149 @@
+package testutil
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// TB is the subset of testing.TB needed to fail a test from inside a
+// MockUpstream handler.
+type TB interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+	Fatalf(format string, args ...interface{})
+}
+
+// HandlerFunc is a single step of a MockUpstream call: it inspects the
+// incoming request and/or writes the response.
+type HandlerFunc func(w http.ResponseWriter, r *http.Request)
+
+// MockUpstream is a fake upstream API whose expected calls are enqueued in
+// order with AppendHandlers. It is inspired by ghttp's
+// CombineHandlers/VerifyRequest/VerifyHeader helpers: every call made to the
+// server must match the next handler in the queue, in order, or the test is
+// marked as failed.
+type MockUpstream struct {
+	*httptest.Server
+
+	tb TB
+
+	mu       sync.Mutex
+	handlers [][]HandlerFunc
+	calls    int
+}
+
+// NewMockUpstream starts a MockUpstream server.
+func NewMockUpstream(tb TB) *MockUpstream {
+	m := &MockUpstream{tb: tb}
+	m.Server = httptest.NewServer(http.HandlerFunc(m.serveHTTP))
+
+	return m
+}
+
+// AppendHandlers enqueues one expected call, CombineHandlers-style: every
+// handler given runs, in order, against the same request/response pair.
+func (m *MockUpstream) AppendHandlers(handlers ...HandlerFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.handlers = append(m.handlers, handlers)
+}
+
+func (m *MockUpstream) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	m.tb.Helper()
+
+	m.mu.Lock()
+	if m.calls >= len(m.handlers) {
+		m.mu.Unlock()
+		m.tb.Fatalf("MockUpstream: unexpected call %s %s, no handler left", r.Method, r.URL)
+		return
+	}
+	handlers := m.handlers[m.calls]
+	m.calls++
+	m.mu.Unlock()
+
+	r = r.WithContext(context.WithValue(r.Context(), tbKey{}, m.tb))
+	for _, h := range handlers {
+		h(w, r)
+	}
+}
+
+// VerifyRequest fails the test unless the request's method and path match.
+func VerifyRequest(method, path string) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			failf(r, "expected method %s, got %s", method, r.Method)
+		}
+		if r.URL.Path != path {
+			failf(r, "expected path %s, got %s", path, r.URL.Path)
+		}
+	}
+}
+
+// VerifyHeader fails the test unless every value of every header in want is
+// present in the request.
+func VerifyHeader(want http.Header) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range want {
+			got := r.Header.Values(name)
+			for _, v := range values {
+				if !contains(got, v) {
+					failf(r, "expected header %s to contain %q, got %v", name, v, got)
+				}
+			}
+		}
+	}
+}
+
+// VerifyMissingHeader fails the test if any of the named headers are present
+// on the request — used to assert hop-by-hop headers were stripped.
+func VerifyMissingHeader(names ...string) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range names {
+			if r.Header.Get(name) != "" {
+				failf(r, "expected header %s to be stripped, got %q", name, r.Header.Get(name))
+			}
+		}
+	}
+}
+
+// RespondWithJSON writes status with obj marshaled as the response body.
+func RespondWithJSON(status int, obj interface{}) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, err := json.Marshal(obj)
+		if err != nil {
+			failf(r, "cannot marshal response: %v", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(b)
+	}
+}
+
+func contains(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tbKey carries the MockUpstream's TB through the request context so that
+// VerifyRequest/VerifyHeader-style handlers, which only see the request, can
+// fail the test.
+type tbKey struct{}
+
+func failf(r *http.Request, format string, args ...interface{}) {
+	if tb, ok := r.Context().Value(tbKey{}).(TB); ok {
+		tb.Helper()
+		tb.Errorf(format, args...)
+		return
+	}
+}
@@ -0,0 +1,183 @@
+// Package testutil provides test-only helpers for the gateway package's test
+// suite.
+package testutil
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// PushedResource is a resource the server pushed alongside the response to
+// the initial request, via an HTTP/2 PUSH_PROMISE.
+type PushedResource struct {
+	Path    string
+	Headers http.Header
+	Body    []byte
+}
+
+// CollectPushes performs an HTTP/2 GET request against rawURL directly at the
+// framing layer and returns both the response to that request and every
+// resource the server pushed alongside it.
+//
+// This exists because net/http's client has no way to observe pushed streams
+// (https://github.com/golang/go/issues/18594), which otherwise forces the
+// push test suite to shell out to an external HTTP/2 client.
+func CollectPushes(tlsConfig *tls.Config, rawURL string, headers http.Header) (mainResp *http.Response, pushed []PushedResource, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h2Config := tlsConfig.Clone()
+	h2Config.NextProtos = []string{"h2"}
+
+	conn, err := tls.Dial("tcp", u.Host, h2Config)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(http2.ClientPreface)); err != nil {
+		return nil, nil, err
+	}
+
+	framer := http2.NewFramer(conn, conn)
+	if err := framer.WriteSettings(); err != nil {
+		return nil, nil, err
+	}
+
+	var headerBuf bytes.Buffer
+	enc := hpack.NewEncoder(&headerBuf)
+	enc.WriteField(hpack.HeaderField{Name: ":method", Value: "GET"})
+	enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "https"})
+	enc.WriteField(hpack.HeaderField{Name: ":authority", Value: u.Host})
+	enc.WriteField(hpack.HeaderField{Name: ":path", Value: u.RequestURI()})
+	for name, values := range headers {
+		for _, value := range values {
+			enc.WriteField(hpack.HeaderField{Name: strings.ToLower(name), Value: value})
+		}
+	}
+
+	const mainStreamID = 1
+	if err := framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      mainStreamID,
+		BlockFragment: headerBuf.Bytes(),
+		EndStream:     true,
+		EndHeaders:    true,
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	dec := hpack.NewDecoder(4096, nil)
+	headersByStream := map[uint32][]hpack.HeaderField{}
+	bodyByStream := map[uint32]*bytes.Buffer{}
+	pushStreams := map[uint32]bool{}
+	pushPath := map[uint32]string{}
+	mainDone := false
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for !mainDone || len(pushStreams) > 0 {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			break
+		}
+
+		switch f := frame.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				framer.WriteSettingsAck()
+			}
+
+		case *http2.PushPromiseFrame:
+			fields, err := dec.DecodeFull(f.HeaderBlockFragment())
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, field := range fields {
+				if field.Name == ":path" {
+					pushPath[f.PromiseID] = field.Value
+				}
+			}
+			bodyByStream[f.PromiseID] = &bytes.Buffer{}
+			pushStreams[f.PromiseID] = true
+
+		case *http2.HeadersFrame:
+			fields, err := dec.DecodeFull(f.HeaderBlockFragment())
+			if err != nil {
+				return nil, nil, err
+			}
+			headersByStream[f.StreamID] = fields
+			if _, ok := bodyByStream[f.StreamID]; !ok {
+				bodyByStream[f.StreamID] = &bytes.Buffer{}
+			}
+			if f.StreamEnded() {
+				if f.StreamID == mainStreamID {
+					mainDone = true
+				} else {
+					delete(pushStreams, f.StreamID)
+				}
+			}
+
+		case *http2.DataFrame:
+			if buf, ok := bodyByStream[f.StreamID]; ok {
+				buf.Write(f.Data())
+			}
+			if f.StreamEnded() {
+				if f.StreamID == mainStreamID {
+					mainDone = true
+				} else {
+					delete(pushStreams, f.StreamID)
+				}
+			}
+		}
+	}
+
+	mainResp = responseFromFrames(headersByStream[mainStreamID], bodyByStream[mainStreamID])
+
+	for streamID := range headersByStream {
+		if streamID == mainStreamID {
+			continue
+		}
+
+		resp := responseFromFrames(headersByStream[streamID], bodyByStream[streamID])
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		pushed = append(pushed, PushedResource{Path: pushPath[streamID], Headers: resp.Header, Body: body})
+	}
+
+	return mainResp, pushed, nil
+}
+
+func responseFromFrames(fields []hpack.HeaderField, body *bytes.Buffer) *http.Response {
+	resp := &http.Response{Header: http.Header{}}
+	if body == nil {
+		body = &bytes.Buffer{}
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body.Bytes()))
+
+	for _, field := range fields {
+		switch {
+		case field.Name == ":status":
+			resp.StatusCode, _ = strconv.Atoi(field.Value)
+		case !strings.HasPrefix(field.Name, ":"):
+			resp.Header.Add(field.Name, field.Value)
+		}
+	}
+
+	if resp.StatusCode == 0 {
+		resp.StatusCode = http.StatusOK
+	}
+	resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+
+	return resp
+}
@@ -0,0 +1,92 @@
+// Command vulcain starts the Vulcain gateway.
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/namsral/flag"
+
+	"github.com/dunglas/vulcain/gateway"
+)
+
+func main() {
+	var (
+		addr        = flag.String("addr", ":8080", "the address to listen on")
+		certFile    = flag.String("cert_file", "", "the path to the TLS certificate")
+		keyFile     = flag.String("key_file", "", "the path to the TLS private key")
+		upstream    = flag.String("upstream", "", "the URL of the upstream API")
+		maxPushes   = flag.Int("max_pushes", -1, "the maximum number of resources to push per response, -1 for no limit")
+		openAPIFile = flag.String("open_api_file", "", "the path to an OpenAPI file describing the relations between resources")
+
+		upstreamProxy         = flag.String("upstream_proxy", "", "the URL of the proxy to use to reach the upstream API")
+		upstreamProxyUser     = flag.String("upstream_proxy_user", "", "the username to authenticate to the upstream proxy")
+		upstreamProxyPassword = flag.String("upstream_proxy_password", "", "the password to authenticate to the upstream proxy")
+
+		useProxyProtocol = flag.Bool("use_proxy_protocol", false, "recover the client address from a PROXY protocol v1/v2 header")
+		trustedProxies   = flag.String("trusted_proxies", "", "comma separated list of CIDRs allowed to send a PROXY protocol header")
+
+		upstreamCAFile          = flag.String("upstream_ca_file", "", "the path to a PEM-encoded CA bundle trusted to verify the upstream certificate")
+		upstreamClientCertFile  = flag.String("upstream_client_cert_file", "", "the path to a client certificate presented to the upstream API")
+		upstreamClientKeyFile   = flag.String("upstream_client_key_file", "", "the path to the private key matching upstream_client_cert_file")
+		upstreamInsecureSkipTLS = flag.Bool("upstream_insecure_skip_tls", false, "do not verify the upstream TLS certificate, for development only")
+	)
+	flag.Parse()
+
+	upstreamURL, err := url.Parse(*upstream)
+	if err != nil {
+		log.Fatalf("vulcain: invalid upstream URL: %v", err)
+	}
+
+	if *upstreamProxy != "" {
+		if _, err := url.Parse(*upstreamProxy); err != nil {
+			log.Fatalf("vulcain: invalid upstream proxy URL: %v", err)
+		}
+	}
+
+	var upstreamCABundle []byte
+	if *upstreamCAFile != "" {
+		upstreamCABundle, err = ioutil.ReadFile(*upstreamCAFile)
+		if err != nil {
+			log.Fatalf("vulcain: cannot read upstream CA file: %v", err)
+		}
+	}
+
+	g := gateway.NewGateway(&gateway.Options{
+		Addr:        *addr,
+		CertFile:    *certFile,
+		KeyFile:     *keyFile,
+		Upstream:    upstreamURL,
+		MaxPushes:   *maxPushes,
+		OpenAPIFile: *openAPIFile,
+		Proxy: &gateway.ProxyOptions{
+			URL:      *upstreamProxy,
+			Username: *upstreamProxyUser,
+			Password: *upstreamProxyPassword,
+		},
+		UseProxyProtocol: *useProxyProtocol,
+		TrustedProxies:   splitAndTrim(*trustedProxies),
+
+		UpstreamCABundle:        upstreamCABundle,
+		UpstreamClientCertFile:  *upstreamClientCertFile,
+		UpstreamClientKeyFile:   *upstreamClientKeyFile,
+		UpstreamInsecureSkipTLS: *upstreamInsecureSkipTLS,
+	})
+
+	log.Fatal(g.Serve())
+}
+
+func splitAndTrim(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	parts := strings.Split(s, ",")
+	for i, p := range parts {
+		parts[i] = strings.TrimSpace(p)
+	}
+
+	return parts
+}